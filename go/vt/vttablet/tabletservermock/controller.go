@@ -92,6 +92,21 @@ type Controller struct {
 
 	// queryRulesMap has the latest query rules.
 	queryRulesMap map[string]*rules.Rules
+
+	// queryService is the mock QueryService returned by QueryService().
+	queryService *FakeQueryService
+
+	// terTimestamp is the tablet externally reparented timestamp broadcast
+	// by BroadcastHealth. Set by SetTERTimestamp.
+	terTimestamp int64
+
+	// realtimeStats is the stats broadcast by BroadcastHealth. Set by
+	// SetRealtimeStats.
+	realtimeStats *querypb.RealtimeStats
+
+	// stopPeriodicBroadcast, if set, stops the goroutine started by
+	// StartPeriodicBroadcast.
+	stopPeriodicBroadcast chan struct{}
 }
 
 // NewController returns a mock of tabletserver.Controller
@@ -102,6 +117,8 @@ func NewController() *Controller {
 		BroadcastData:       make(chan *BroadcastData, 10),
 		StateChanges:        make(chan *StateChange, 10),
 		queryRulesMap:       make(map[string]*rules.Rules),
+		queryService:        NewFakeQueryService(),
+		realtimeStats:       &querypb.RealtimeStats{},
 	}
 }
 
@@ -190,12 +207,20 @@ func (tqsc *Controller) SetQueryRules(ruleSource string, qrs *rules.Rules) error
 	tqsc.mu.Lock()
 	defer tqsc.mu.Unlock()
 	tqsc.queryRulesMap[ruleSource] = qrs
+	tqsc.queryService.setQueryRules(tqsc.unionQueryRulesLocked())
 	return nil
 }
 
 // QueryService is part of the tabletserver.Controller interface
 func (tqsc *Controller) QueryService() queryservice.QueryService {
-	return nil
+	return tqsc.queryService
+}
+
+// FakeQueryService returns the underlying FakeQueryService so tests can
+// script its behavior (register handlers, inspect recorded queries, assert
+// transaction/reserved-connection state).
+func (tqsc *Controller) FakeQueryService() *FakeQueryService {
+	return tqsc.queryService
 }
 
 // SchemaEngine is part of the tabletserver.Controller interface
@@ -205,12 +230,96 @@ func (tqsc *Controller) SchemaEngine() *schema.Engine {
 
 // BroadcastHealth is part of the tabletserver.Controller interface
 func (tqsc *Controller) BroadcastHealth() {
+	tqsc.mu.Lock()
+	data := &BroadcastData{
+		TERTimestamp:  tqsc.terTimestamp,
+		RealtimeStats: *tqsc.realtimeStats,
+		Serving:       tqsc.queryServiceEnabled && (!tqsc.isInLameduck),
+	}
+	tqsc.mu.Unlock()
+
+	// Send without holding tqsc.mu: StopPeriodicBroadcast also needs that
+	// lock, and BroadcastData is a small buffered channel a test may not be
+	// draining as fast as StartPeriodicBroadcast fires. If the channel is
+	// full, drop the oldest entry instead of blocking forever.
+	select {
+	case tqsc.BroadcastData <- data:
+	default:
+		select {
+		case <-tqsc.BroadcastData:
+		default:
+		}
+		select {
+		case tqsc.BroadcastData <- data:
+		default:
+		}
+	}
+}
+
+// SetRealtimeStats sets the RealtimeStats sent by the next BroadcastHealth
+// call(s), so tests can simulate a tablet whose replication lag, CPU usage,
+// qps or error rate changes over time.
+func (tqsc *Controller) SetRealtimeStats(stats *querypb.RealtimeStats) {
 	tqsc.mu.Lock()
 	defer tqsc.mu.Unlock()
+	if stats == nil {
+		stats = &querypb.RealtimeStats{}
+	}
+	tqsc.realtimeStats = stats
+}
 
-	tqsc.BroadcastData <- &BroadcastData{
-		Serving: tqsc.queryServiceEnabled && (!tqsc.isInLameduck),
+// SetTERTimestamp sets the tablet externally reparented timestamp sent by
+// the next BroadcastHealth call(s).
+func (tqsc *Controller) SetTERTimestamp(terTimestamp int64) {
+	tqsc.mu.Lock()
+	defer tqsc.mu.Unlock()
+	tqsc.terTimestamp = terTimestamp
+}
+
+// StartPeriodicBroadcast starts a goroutine that calls BroadcastHealth every
+// interval, so tests can simulate a tablet that keeps streaming health
+// updates (e.g. lag that grows past a threshold, or flapping servingness)
+// without having to call BroadcastHealth by hand. Call StopPeriodicBroadcast
+// to stop it.
+func (tqsc *Controller) StartPeriodicBroadcast(interval time.Duration) {
+	tqsc.mu.Lock()
+	defer tqsc.mu.Unlock()
+
+	if tqsc.stopPeriodicBroadcast != nil {
+		return
 	}
+	stop := make(chan struct{})
+	tqsc.stopPeriodicBroadcast = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				tqsc.BroadcastHealth()
+			}
+		}
+	}()
+}
+
+// StopPeriodicBroadcast stops the goroutine started by
+// StartPeriodicBroadcast. It is a no-op if none is running. Once it returns,
+// that goroutine sends nothing more on BroadcastData.
+func (tqsc *Controller) StopPeriodicBroadcast() {
+	tqsc.mu.Lock()
+	stop := tqsc.stopPeriodicBroadcast
+	tqsc.stopPeriodicBroadcast = nil
+	tqsc.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	// The goroutine only receives this between broadcasts, so a
+	// BroadcastHealth call already in progress finishes first. tqsc.mu is
+	// released above because that call needs it.
+	stop <- struct{}{}
 }
 
 // TopoServer is part of the tabletserver.Controller interface.
@@ -240,3 +349,26 @@ func (tqsc *Controller) GetQueryRules(ruleSource string) *rules.Rules {
 	defer tqsc.mu.Unlock()
 	return tqsc.queryRulesMap[ruleSource]
 }
+
+// unionQueryRulesLocked merges every registered rule source into a single
+// Rules set, the same way tabletserver's QueryEngine evaluates the union of
+// all its rule sources. tqsc.mu must be held.
+func (tqsc *Controller) unionQueryRulesLocked() *rules.Rules {
+	union := rules.New()
+	for _, qrs := range tqsc.queryRulesMap {
+		union.Append(qrs)
+	}
+	return union
+}
+
+// QueryRuleStats returns the counters tracking how many queries matched,
+// were denied or were buffered by the registered query rules, and how many
+// rule evaluations were skipped because a rule's query, plan or table scope
+// didn't apply. tabletenv.Stats (returned by Stats()) is
+// the real tabletserver's production stats struct, shared verbatim by this
+// mock; it isn't ours to grow test-only counters on, so this accessor lives
+// alongside the mock's other test-facing state (BroadcastData, GetQueryRules)
+// instead.
+func (tqsc *Controller) QueryRuleStats() QueryRuleStats {
+	return tqsc.queryService.QueryRuleStats()
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletservermock
+
+import (
+	"testing"
+	"time"
+
+	querypb "vitess.io/vitess/go/vt/proto/query"
+)
+
+func TestControllerBroadcastHealth(t *testing.T) {
+	ctl := NewController()
+	ctl.SetTERTimestamp(42)
+	ctl.SetRealtimeStats(&querypb.RealtimeStats{ReplicationLagSeconds: 5})
+
+	ctl.BroadcastHealth()
+
+	select {
+	case data := <-ctl.BroadcastData:
+		if data.TERTimestamp != 42 {
+			t.Errorf("TERTimestamp = %d, want 42", data.TERTimestamp)
+		}
+		if data.RealtimeStats.ReplicationLagSeconds != 5 {
+			t.Errorf("ReplicationLagSeconds = %d, want 5", data.RealtimeStats.ReplicationLagSeconds)
+		}
+	default:
+		t.Fatal("BroadcastHealth did not send on BroadcastData")
+	}
+}
+
+func TestControllerSetRealtimeStatsNilDoesNotPanic(t *testing.T) {
+	ctl := NewController()
+	ctl.SetRealtimeStats(nil)
+
+	ctl.BroadcastHealth()
+
+	select {
+	case data := <-ctl.BroadcastData:
+		if data.RealtimeStats.ReplicationLagSeconds != 0 {
+			t.Errorf("ReplicationLagSeconds = %d, want 0", data.RealtimeStats.ReplicationLagSeconds)
+		}
+	default:
+		t.Fatal("BroadcastHealth did not send on BroadcastData")
+	}
+}
+
+func TestControllerStartStopPeriodicBroadcast(t *testing.T) {
+	ctl := NewController()
+	ctl.SetRealtimeStats(&querypb.RealtimeStats{ReplicationLagSeconds: 1})
+
+	ctl.StartPeriodicBroadcast(5 * time.Millisecond)
+	// Starting a second time while one is already running must be a no-op,
+	// not spawn a second goroutine.
+	ctl.StartPeriodicBroadcast(5 * time.Millisecond)
+
+	select {
+	case data := <-ctl.BroadcastData:
+		if data.RealtimeStats.ReplicationLagSeconds != 1 {
+			t.Errorf("ReplicationLagSeconds = %d, want 1", data.RealtimeStats.ReplicationLagSeconds)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("periodic broadcast did not send on BroadcastData")
+	}
+
+	ctl.StopPeriodicBroadcast()
+	// Draining what's already buffered, then waiting, should show no more
+	// arrivals once the goroutine has actually stopped.
+	for drained := true; drained; {
+		select {
+		case <-ctl.BroadcastData:
+		default:
+			drained = false
+		}
+	}
+	select {
+	case <-ctl.BroadcastData:
+		t.Fatal("received a broadcast after StopPeriodicBroadcast")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Stopping again, and stopping a Controller that never started, must
+	// both be no-ops rather than panic.
+	ctl.StopPeriodicBroadcast()
+	NewController().StopPeriodicBroadcast()
+}
+
+func TestControllerBroadcastHealthDropsOldestWhenFull(t *testing.T) {
+	ctl := NewController()
+
+	// BroadcastData is buffered to 10; fill it past capacity and confirm
+	// BroadcastHealth never blocks.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			ctl.SetTERTimestamp(int64(i))
+			ctl.BroadcastHealth()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("BroadcastHealth blocked with a full BroadcastData channel")
+	}
+
+	if got := len(ctl.BroadcastData); got != cap(ctl.BroadcastData) {
+		t.Errorf("len(BroadcastData) = %d, want %d (channel should be full, oldest entries dropped)", got, cap(ctl.BroadcastData))
+	}
+	// Broadcasts 0..9 filled the channel; each of 10..19 dropped the oldest,
+	// so the oldest entry left is the one sent with TERTimestamp 10.
+	if data := <-ctl.BroadcastData; data.TERTimestamp != 10 {
+		t.Errorf("oldest remaining TERTimestamp = %d, want 10", data.TERTimestamp)
+	}
+}
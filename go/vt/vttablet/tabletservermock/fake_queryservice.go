@@ -0,0 +1,568 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletservermock
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"vitess.io/vitess/go/sqltypes"
+	"vitess.io/vitess/go/vt/callerid"
+	"vitess.io/vitess/go/vt/vterrors"
+	"vitess.io/vitess/go/vt/vttablet/queryservice"
+	"vitess.io/vitess/go/vt/vttablet/tabletserver/planbuilder"
+	"vitess.io/vitess/go/vt/vttablet/tabletserver/rules"
+
+	binlogdatapb "vitess.io/vitess/go/vt/proto/binlogdata"
+	querypb "vitess.io/vitess/go/vt/proto/query"
+	vtrpcpb "vitess.io/vitess/go/vt/proto/vtrpc"
+)
+
+// QueryRuleStats holds the counters incremented as FakeQueryService
+// evaluates query rules, mirroring how tabletserver's QueryEngine enforces
+// them, so tests can assert that a specific rule fired.
+type QueryRuleStats struct {
+	// Matched counts the queries that matched at least one rule.
+	Matched int64
+	// Denied counts the queries denied by a QRFail/QRFailRetry rule.
+	Denied int64
+	// Buffered counts the queries that hit a QRBuffer rule.
+	Buffered int64
+	// Filtered counts the rule evaluations skipped because the rule's query
+	// pattern, plan or table scope didn't apply to the query being run.
+	Filtered int64
+}
+
+// tableNameRE picks out the table name(s) a query touches well enough to
+// apply table-scoped query rules. It isn't a real SQL parser: it just looks
+// for the identifier that follows FROM/INTO/UPDATE/JOIN, which is all the
+// mock needs to exercise table-scoped rules in tests.
+var tableNameRE = regexp.MustCompile("(?i)\\b(?:from|into|update|join)\\s+`?([a-zA-Z0-9_.]+)`?")
+
+// extractTableNames returns the table names referenced by sql, best-effort.
+func extractTableNames(sql string) []string {
+	matches := tableNameRE.FindAllStringSubmatch(sql, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool, len(matches))
+	names := make([]string, 0, len(matches))
+	for _, m := range matches {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			names = append(names, m[1])
+		}
+	}
+	return names
+}
+
+// classifyPlan returns a coarse planbuilder.PlanType for sql, based on its
+// leading keyword. It's a stand-in for the real planbuilder (which the mock
+// doesn't run), good enough to exercise per-plan query rules in tests.
+func classifyPlan(sql string) planbuilder.PlanType {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return planbuilder.PlanOther
+	}
+	switch strings.ToLower(fields[0]) {
+	case "select":
+		return planbuilder.PlanSelect
+	case "insert", "replace":
+		return planbuilder.PlanInsert
+	case "update":
+		return planbuilder.PlanUpdate
+	case "delete":
+		return planbuilder.PlanDelete
+	default:
+		return planbuilder.PlanOther
+	}
+}
+
+// ExecuteHandler is the signature tests register with
+// FakeQueryService.RegisterExecuteHandler to script the result of Execute.
+type ExecuteHandler func(query string, bindVariables map[string]*querypb.BindVariable) (*sqltypes.Result, error)
+
+// StreamExecuteHandler is the signature tests register with
+// FakeQueryService.RegisterStreamExecuteHandler to script the rows sent back
+// by StreamExecute.
+type StreamExecuteHandler func(query string, bindVariables map[string]*querypb.BindVariable, callback func(*sqltypes.Result) error) error
+
+// BeginHandler is the signature tests register with
+// FakeQueryService.RegisterBeginHandler to control the outcome of Begin.
+type BeginHandler func(target *querypb.Target) error
+
+// CommitHandler is the signature tests register with
+// FakeQueryService.RegisterCommitHandler to control the outcome of Commit.
+type CommitHandler func(transactionID int64) error
+
+// RollbackHandler is the signature tests register with
+// FakeQueryService.RegisterRollbackHandler to control the outcome of
+// Rollback.
+type RollbackHandler func(transactionID int64) error
+
+// ReserveExecuteHandler is the signature tests register with
+// FakeQueryService.RegisterReserveExecuteHandler to script the result of
+// ReserveExecute.
+type ReserveExecuteHandler func(query string, bindVariables map[string]*querypb.BindVariable) (*sqltypes.Result, error)
+
+// VStreamHandler is the signature tests register with
+// FakeQueryService.RegisterVStreamHandler to script the events sent back by
+// VStream.
+type VStreamHandler func(startPos string, filter *binlogdatapb.Filter, send func([]*binlogdatapb.VEvent) error) error
+
+// RecordedQuery stores a single Execute / StreamExecute / ReserveExecute call
+// so tests can assert on exactly what the mock received.
+type RecordedQuery struct {
+	Method        string
+	SQL           string
+	BindVariables map[string]*querypb.BindVariable
+	TransactionID int64
+	ReservedID    int64
+}
+
+// FakeQueryService is a scriptable queryservice.QueryService used by
+// Controller.QueryService(). Tests register handlers for the calls they care
+// about; anything else falls back to a harmless default so the mock can
+// stand in for a real tabletserver in vtgate and orchestration tests.
+type FakeQueryService struct {
+	mu sync.Mutex
+
+	executeHandler        ExecuteHandler
+	streamExecuteHandler  StreamExecuteHandler
+	beginHandler          BeginHandler
+	commitHandler         CommitHandler
+	rollbackHandler       RollbackHandler
+	reserveExecuteHandler ReserveExecuteHandler
+	vStreamHandler        VStreamHandler
+
+	lastTransactionID int64
+	lastReservedID    int64
+	openTransactions  map[int64]bool
+	openReserved      map[int64]bool
+
+	queries []*RecordedQuery
+
+	// queryRules is the union of every rule source registered on the owning
+	// Controller via SetQueryRules.
+	queryRules *rules.Rules
+	ruleStats  QueryRuleStats
+}
+
+// NewFakeQueryService returns a FakeQueryService ready to be scripted by a
+// test.
+func NewFakeQueryService() *FakeQueryService {
+	return &FakeQueryService{
+		openTransactions: make(map[int64]bool),
+		openReserved:     make(map[int64]bool),
+	}
+}
+
+// RegisterExecuteHandler sets the function called by Execute.
+func (f *FakeQueryService) RegisterExecuteHandler(h ExecuteHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.executeHandler = h
+}
+
+// RegisterStreamExecuteHandler sets the function called by StreamExecute.
+func (f *FakeQueryService) RegisterStreamExecuteHandler(h StreamExecuteHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.streamExecuteHandler = h
+}
+
+// RegisterBeginHandler sets the function called by Begin.
+func (f *FakeQueryService) RegisterBeginHandler(h BeginHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.beginHandler = h
+}
+
+// RegisterCommitHandler sets the function called by Commit.
+func (f *FakeQueryService) RegisterCommitHandler(h CommitHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commitHandler = h
+}
+
+// RegisterRollbackHandler sets the function called by Rollback.
+func (f *FakeQueryService) RegisterRollbackHandler(h RollbackHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rollbackHandler = h
+}
+
+// RegisterReserveExecuteHandler sets the function called by ReserveExecute.
+func (f *FakeQueryService) RegisterReserveExecuteHandler(h ReserveExecuteHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reserveExecuteHandler = h
+}
+
+// RegisterVStreamHandler sets the function called by VStream.
+func (f *FakeQueryService) RegisterVStreamHandler(h VStreamHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.vStreamHandler = h
+}
+
+// Queries returns the queries recorded by Execute, StreamExecute and
+// ReserveExecute, in the order they were received.
+func (f *FakeQueryService) Queries() []*RecordedQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]*RecordedQuery, len(f.queries))
+	copy(out, f.queries)
+	return out
+}
+
+// OpenTransactionIDs returns the transaction ids currently open, i.e.
+// returned by Begin but not yet closed by Commit or Rollback.
+func (f *FakeQueryService) OpenTransactionIDs() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := make([]int64, 0, len(f.openTransactions))
+	for id := range f.openTransactions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// OpenReservedIDs returns the reserved connection ids currently open, i.e.
+// returned by ReserveExecute but not yet closed by Release.
+func (f *FakeQueryService) OpenReservedIDs() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := make([]int64, 0, len(f.openReserved))
+	for id := range f.openReserved {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (f *FakeQueryService) record(q *RecordedQuery) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, q)
+}
+
+func (f *FakeQueryService) nextTransactionID() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastTransactionID++
+	id := f.lastTransactionID
+	f.openTransactions[id] = true
+	return id
+}
+
+func (f *FakeQueryService) nextReservedID() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastReservedID++
+	id := f.lastReservedID
+	f.openReserved[id] = true
+	return id
+}
+
+func (f *FakeQueryService) closeTransaction(transactionID int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.openTransactions, transactionID)
+}
+
+func (f *FakeQueryService) closeReserved(reservedID int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.openReserved, reservedID)
+}
+
+// setQueryRules replaces the rule set evaluated by checkQueryRules. It is
+// called by Controller.SetQueryRules with the union of every registered
+// rule source.
+func (f *FakeQueryService) setQueryRules(qrs *rules.Rules) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queryRules = qrs
+}
+
+// QueryRuleStats returns the counters tracking how many queries matched,
+// were denied, or were buffered by the registered query rules.
+func (f *FakeQueryService) QueryRuleStats() QueryRuleStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ruleStats
+}
+
+// checkQueryRules evaluates sql/bindVariables against the registered query
+// rules, the same way tabletserver's QueryExecutor.checkPermissions
+// evaluates a plan's rules before running a query: rules are first narrowed
+// to the ones whose query pattern and plan/table scope apply to this query
+// (FilterByPlan),
+// then the caller's identity and the bind variables (which is how
+// keyrange-scoped rules match) decide the action.
+func (f *FakeQueryService) checkQueryRules(ctx context.Context, sql string, bindVariables map[string]*querypb.BindVariable) error {
+	f.mu.Lock()
+	qrs := f.queryRules
+	f.mu.Unlock()
+	if qrs == nil || len(*qrs) == 0 {
+		return nil
+	}
+
+	applicable := qrs.FilterByPlan(sql, classifyPlan(sql), extractTableNames(sql)...)
+	if filtered := len(*qrs) - len(*applicable); filtered > 0 {
+		f.mu.Lock()
+		f.ruleStats.Filtered += int64(filtered)
+		f.mu.Unlock()
+	}
+	if len(*applicable) == 0 {
+		return nil
+	}
+
+	user := ""
+	if immediate := callerid.ImmediateCallerIDFromContext(ctx); immediate != nil {
+		user = immediate.GetUsername()
+	}
+
+	action, _, desc := applicable.GetAction("", user, bindVariables)
+	if action == rules.QRContinue {
+		return nil
+	}
+
+	f.mu.Lock()
+	f.ruleStats.Matched++
+	defer f.mu.Unlock()
+
+	switch action {
+	case rules.QRFail:
+		f.ruleStats.Denied++
+		return vterrors.Errorf(vtrpcpb.Code_INVALID_ARGUMENT, "disallowed due to rule: %s", desc)
+	case rules.QRFailRetry:
+		f.ruleStats.Denied++
+		return vterrors.Errorf(vtrpcpb.Code_FAILED_PRECONDITION, "disallowed due to rule: %s", desc)
+	case rules.QRBuffer, rules.QRBufferDryRun:
+		f.ruleStats.Buffered++
+	}
+	return nil
+}
+
+// Execute is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) Execute(ctx context.Context, target *querypb.Target, sql string, bindVariables map[string]*querypb.BindVariable, transactionID, reservedID int64, options *querypb.ExecuteOptions) (*sqltypes.Result, error) {
+	f.record(&RecordedQuery{Method: "Execute", SQL: sql, BindVariables: bindVariables, TransactionID: transactionID, ReservedID: reservedID})
+	if err := f.checkQueryRules(ctx, sql, bindVariables); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	handler := f.executeHandler
+	f.mu.Unlock()
+	if handler == nil {
+		return &sqltypes.Result{}, nil
+	}
+	return handler(sql, bindVariables)
+}
+
+// StreamExecute is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) StreamExecute(ctx context.Context, target *querypb.Target, sql string, bindVariables map[string]*querypb.BindVariable, transactionID, reservedID int64, options *querypb.ExecuteOptions, callback func(*sqltypes.Result) error) error {
+	f.record(&RecordedQuery{Method: "StreamExecute", SQL: sql, BindVariables: bindVariables, TransactionID: transactionID, ReservedID: reservedID})
+	if err := f.checkQueryRules(ctx, sql, bindVariables); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	handler := f.streamExecuteHandler
+	f.mu.Unlock()
+	if handler == nil {
+		return callback(&sqltypes.Result{})
+	}
+	return handler(sql, bindVariables, callback)
+}
+
+// Begin is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) Begin(ctx context.Context, target *querypb.Target, options *querypb.ExecuteOptions) (queryservice.TransactionState, error) {
+	f.mu.Lock()
+	handler := f.beginHandler
+	f.mu.Unlock()
+	if handler != nil {
+		if err := handler(target); err != nil {
+			return queryservice.TransactionState{}, err
+		}
+	}
+	return queryservice.TransactionState{TransactionID: f.nextTransactionID()}, nil
+}
+
+// Commit is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) Commit(ctx context.Context, target *querypb.Target, transactionID int64) (int64, error) {
+	f.mu.Lock()
+	handler := f.commitHandler
+	f.mu.Unlock()
+	if handler != nil {
+		if err := handler(transactionID); err != nil {
+			return 0, err
+		}
+	}
+	f.closeTransaction(transactionID)
+	return 0, nil
+}
+
+// Rollback is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) Rollback(ctx context.Context, target *querypb.Target, transactionID int64) (int64, error) {
+	f.mu.Lock()
+	handler := f.rollbackHandler
+	f.mu.Unlock()
+	if handler != nil {
+		if err := handler(transactionID); err != nil {
+			return 0, err
+		}
+	}
+	f.closeTransaction(transactionID)
+	return 0, nil
+}
+
+// Prepare is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) Prepare(ctx context.Context, target *querypb.Target, transactionID int64, dtid string) error {
+	return nil
+}
+
+// CommitPrepared is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) CommitPrepared(ctx context.Context, target *querypb.Target, dtid string) error {
+	return nil
+}
+
+// RollbackPrepared is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) RollbackPrepared(ctx context.Context, target *querypb.Target, dtid string, originalID int64) error {
+	return nil
+}
+
+// CreateTransaction is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) CreateTransaction(ctx context.Context, target *querypb.Target, dtid string, participants []*querypb.Target) error {
+	return nil
+}
+
+// StartCommit is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) StartCommit(ctx context.Context, target *querypb.Target, transactionID int64, dtid string) error {
+	return nil
+}
+
+// SetRollback is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) SetRollback(ctx context.Context, target *querypb.Target, dtid string, transactionID int64) error {
+	return nil
+}
+
+// ConcludeTransaction is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) ConcludeTransaction(ctx context.Context, target *querypb.Target, dtid string) error {
+	return nil
+}
+
+// ReadTransaction is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) ReadTransaction(ctx context.Context, target *querypb.Target, dtid string) (*querypb.TransactionMetadata, error) {
+	return &querypb.TransactionMetadata{}, nil
+}
+
+// BeginExecute is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) BeginExecute(ctx context.Context, target *querypb.Target, preQueries []string, sql string, bindVariables map[string]*querypb.BindVariable, reservedID int64, options *querypb.ExecuteOptions) (*sqltypes.Result, queryservice.TransactionState, error) {
+	state, err := f.Begin(ctx, target, options)
+	if err != nil {
+		return nil, state, err
+	}
+	result, err := f.Execute(ctx, target, sql, bindVariables, state.TransactionID, reservedID, options)
+	return result, state, err
+}
+
+// BeginStreamExecute is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) BeginStreamExecute(ctx context.Context, target *querypb.Target, preQueries []string, sql string, bindVariables map[string]*querypb.BindVariable, reservedID int64, options *querypb.ExecuteOptions, callback func(*sqltypes.Result) error) (queryservice.TransactionState, error) {
+	state, err := f.Begin(ctx, target, options)
+	if err != nil {
+		return state, err
+	}
+	err = f.StreamExecute(ctx, target, sql, bindVariables, state.TransactionID, reservedID, options, callback)
+	return state, err
+}
+
+// MessageStream is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) MessageStream(ctx context.Context, target *querypb.Target, name string, callback func(*sqltypes.Result) error) error {
+	return nil
+}
+
+// MessageAck is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) MessageAck(ctx context.Context, target *querypb.Target, name string, ids []*querypb.Value) (int64, error) {
+	return 0, nil
+}
+
+// VStream is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) VStream(ctx context.Context, target *querypb.Target, startPos string, tableLastPKs []*binlogdatapb.TableLastPK, filter *binlogdatapb.Filter, send func([]*binlogdatapb.VEvent) error) error {
+	f.mu.Lock()
+	handler := f.vStreamHandler
+	f.mu.Unlock()
+	if handler == nil {
+		return nil
+	}
+	return handler(startPos, filter, send)
+}
+
+// ReserveBeginExecute is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) ReserveBeginExecute(ctx context.Context, target *querypb.Target, preQueries []string, sql string, bindVariables map[string]*querypb.BindVariable, options *querypb.ExecuteOptions) (*sqltypes.Result, queryservice.TransactionState, error) {
+	state, err := f.Begin(ctx, target, options)
+	if err != nil {
+		return nil, state, err
+	}
+	result, _, err := f.ReserveExecute(ctx, target, preQueries, sql, bindVariables, state.TransactionID, options)
+	return result, state, err
+}
+
+// ReserveExecute is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) ReserveExecute(ctx context.Context, target *querypb.Target, preQueries []string, sql string, bindVariables map[string]*querypb.BindVariable, transactionID int64, options *querypb.ExecuteOptions) (*sqltypes.Result, int64, error) {
+	f.record(&RecordedQuery{Method: "ReserveExecute", SQL: sql, BindVariables: bindVariables, TransactionID: transactionID})
+	if err := f.checkQueryRules(ctx, sql, bindVariables); err != nil {
+		return nil, 0, err
+	}
+
+	reservedID := f.nextReservedID()
+	f.mu.Lock()
+	handler := f.reserveExecuteHandler
+	f.mu.Unlock()
+	if handler == nil {
+		return &sqltypes.Result{}, reservedID, nil
+	}
+	result, err := handler(sql, bindVariables)
+	return result, reservedID, err
+}
+
+// Release is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) Release(ctx context.Context, target *querypb.Target, transactionID, reservedID int64) error {
+	if transactionID != 0 {
+		f.closeTransaction(transactionID)
+	}
+	if reservedID != 0 {
+		f.closeReserved(reservedID)
+	}
+	return nil
+}
+
+// StreamHealth is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) StreamHealth(ctx context.Context, callback func(*querypb.StreamHealthResponse) error) error {
+	return nil
+}
+
+// HandlePanic is part of the queryservice.QueryService interface.
+func (f *FakeQueryService) HandlePanic(err *error) {
+	if x := recover(); x != nil {
+		*err = fmt.Errorf("uncaught panic: %v", x)
+	}
+}
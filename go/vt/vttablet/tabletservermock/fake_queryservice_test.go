@@ -0,0 +1,223 @@
+/*
+Copyright 2019 The Vitess Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tabletservermock
+
+import (
+	"context"
+	"testing"
+
+	"vitess.io/vitess/go/sqltypes"
+	"vitess.io/vitess/go/vt/vterrors"
+	"vitess.io/vitess/go/vt/vttablet/tabletserver/rules"
+
+	binlogdatapb "vitess.io/vitess/go/vt/proto/binlogdata"
+	querypb "vitess.io/vitess/go/vt/proto/query"
+	vtrpcpb "vitess.io/vitess/go/vt/proto/vtrpc"
+)
+
+func TestFakeQueryServiceExecute(t *testing.T) {
+	ctl := NewController()
+	fq := ctl.FakeQueryService()
+
+	var gotQuery string
+	var gotBindVariables map[string]*querypb.BindVariable
+	fq.RegisterExecuteHandler(func(query string, bindVariables map[string]*querypb.BindVariable) (*sqltypes.Result, error) {
+		gotQuery = query
+		gotBindVariables = bindVariables
+		return &sqltypes.Result{RowsAffected: 1}, nil
+	})
+
+	bv := map[string]*querypb.BindVariable{"id": sqltypes.Int64BindVariable(1)}
+	result, err := fq.Execute(context.Background(), &querypb.Target{}, "select 1 from t1 where id = :id", bv, 0, 0, &querypb.ExecuteOptions{})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if result.RowsAffected != 1 {
+		t.Errorf("RowsAffected = %d, want 1", result.RowsAffected)
+	}
+	if gotQuery == "" || gotBindVariables == nil {
+		t.Errorf("registered handler did not receive query/bindvars")
+	}
+
+	queries := fq.Queries()
+	if len(queries) != 1 || queries[0].SQL != gotQuery {
+		t.Errorf("Queries() = %v, want a single recorded Execute call", queries)
+	}
+}
+
+func TestFakeQueryServiceBeginCommit(t *testing.T) {
+	ctl := NewController()
+	fq := ctl.FakeQueryService()
+
+	state, err := fq.Begin(context.Background(), &querypb.Target{}, &querypb.ExecuteOptions{})
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	if got := fq.OpenTransactionIDs(); len(got) != 1 {
+		t.Fatalf("OpenTransactionIDs() = %v, want one open transaction", got)
+	}
+
+	if _, err := fq.Commit(context.Background(), &querypb.Target{}, state.TransactionID); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if got := fq.OpenTransactionIDs(); len(got) != 0 {
+		t.Errorf("OpenTransactionIDs() = %v, want none open after Commit", got)
+	}
+}
+
+func TestFakeQueryServiceRollback(t *testing.T) {
+	ctl := NewController()
+	fq := ctl.FakeQueryService()
+
+	state, err := fq.Begin(context.Background(), &querypb.Target{}, &querypb.ExecuteOptions{})
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+
+	if _, err := fq.Rollback(context.Background(), &querypb.Target{}, state.TransactionID); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if got := fq.OpenTransactionIDs(); len(got) != 0 {
+		t.Errorf("OpenTransactionIDs() = %v, want none open after Rollback", got)
+	}
+}
+
+func TestFakeQueryServiceReserveExecuteRelease(t *testing.T) {
+	ctl := NewController()
+	fq := ctl.FakeQueryService()
+
+	var gotQuery string
+	fq.RegisterReserveExecuteHandler(func(query string, bindVariables map[string]*querypb.BindVariable) (*sqltypes.Result, error) {
+		gotQuery = query
+		return &sqltypes.Result{RowsAffected: 1}, nil
+	})
+
+	result, reservedID, err := fq.ReserveExecute(context.Background(), &querypb.Target{}, nil, "select 1 from t1", nil, 0, &querypb.ExecuteOptions{})
+	if err != nil {
+		t.Fatalf("ReserveExecute failed: %v", err)
+	}
+	if result.RowsAffected != 1 {
+		t.Errorf("RowsAffected = %d, want 1", result.RowsAffected)
+	}
+	if gotQuery == "" {
+		t.Errorf("registered handler did not receive query")
+	}
+	if got := fq.OpenReservedIDs(); len(got) != 1 || got[0] != reservedID {
+		t.Fatalf("OpenReservedIDs() = %v, want [%d]", got, reservedID)
+	}
+
+	if err := fq.Release(context.Background(), &querypb.Target{}, 0, reservedID); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if got := fq.OpenReservedIDs(); len(got) != 0 {
+		t.Errorf("OpenReservedIDs() = %v, want none open after Release", got)
+	}
+}
+
+func TestFakeQueryServiceStreamExecute(t *testing.T) {
+	ctl := NewController()
+	fq := ctl.FakeQueryService()
+
+	fq.RegisterStreamExecuteHandler(func(query string, bindVariables map[string]*querypb.BindVariable, callback func(*sqltypes.Result) error) error {
+		return callback(&sqltypes.Result{RowsAffected: 1})
+	})
+
+	var gotRows int
+	err := fq.StreamExecute(context.Background(), &querypb.Target{}, "select 1 from t1", nil, 0, 0, &querypb.ExecuteOptions{}, func(result *sqltypes.Result) error {
+		gotRows = int(result.RowsAffected)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamExecute failed: %v", err)
+	}
+	if gotRows != 1 {
+		t.Errorf("callback saw RowsAffected = %d, want 1", gotRows)
+	}
+
+	queries := fq.Queries()
+	if len(queries) != 1 || queries[0].Method != "StreamExecute" {
+		t.Errorf("Queries() = %v, want a single recorded StreamExecute call", queries)
+	}
+}
+
+func TestFakeQueryServiceVStream(t *testing.T) {
+	ctl := NewController()
+	fq := ctl.FakeQueryService()
+
+	var gotStartPos string
+	fq.RegisterVStreamHandler(func(startPos string, filter *binlogdatapb.Filter, send func([]*binlogdatapb.VEvent) error) error {
+		gotStartPos = startPos
+		return send([]*binlogdatapb.VEvent{{Type: binlogdatapb.VEventType_COMMIT}})
+	})
+
+	var gotEvents []*binlogdatapb.VEvent
+	err := fq.VStream(context.Background(), &querypb.Target{}, "pos1", nil, &binlogdatapb.Filter{}, func(events []*binlogdatapb.VEvent) error {
+		gotEvents = events
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("VStream failed: %v", err)
+	}
+	if gotStartPos != "pos1" {
+		t.Errorf("handler saw startPos = %q, want %q", gotStartPos, "pos1")
+	}
+	if len(gotEvents) != 1 {
+		t.Errorf("send callback saw %d events, want 1", len(gotEvents))
+	}
+}
+
+func TestFakeQueryServiceExecuteErrorPropagation(t *testing.T) {
+	ctl := NewController()
+	fq := ctl.FakeQueryService()
+
+	fq.RegisterExecuteHandler(func(query string, bindVariables map[string]*querypb.BindVariable) (*sqltypes.Result, error) {
+		return nil, vterrors.Errorf(vtrpcpb.Code_RESOURCE_EXHAUSTED, "pool is full")
+	})
+
+	_, err := fq.Execute(context.Background(), &querypb.Target{}, "select 1 from t1", nil, 0, 0, &querypb.ExecuteOptions{})
+	if err == nil {
+		t.Fatal("Execute did not propagate the handler's error")
+	}
+	if got := vterrors.Code(err); got != vtrpcpb.Code_RESOURCE_EXHAUSTED {
+		t.Errorf("vterrors.Code(err) = %v, want %v", got, vtrpcpb.Code_RESOURCE_EXHAUSTED)
+	}
+}
+
+func TestFakeQueryServiceQueryRuleDenial(t *testing.T) {
+	ctl := NewController()
+	fq := ctl.FakeQueryService()
+
+	qr := rules.NewQueryRule("deny all selects", "deny_select", rules.QRFail)
+	if err := qr.SetQueryCondition("select.*"); err != nil {
+		t.Fatalf("SetQueryCondition failed: %v", err)
+	}
+	qrs := rules.New()
+	qrs.Add(qr)
+	if err := ctl.SetQueryRules("test", qrs); err != nil {
+		t.Fatalf("SetQueryRules failed: %v", err)
+	}
+
+	_, err := fq.Execute(context.Background(), &querypb.Target{}, "select 1 from t1", nil, 0, 0, &querypb.ExecuteOptions{})
+	if err == nil {
+		t.Fatal("Execute did not return an error for a query denied by a QRFail rule")
+	}
+
+	stats := ctl.QueryRuleStats()
+	if stats.Denied != 1 {
+		t.Errorf("QueryRuleStats().Denied = %d, want 1", stats.Denied)
+	}
+}